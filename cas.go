@@ -0,0 +1,176 @@
+package gongflow
+
+import (
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// ErrChunkChecksumMismatch is returned from ChunkUpload when a chunk doesn't match the
+// flowChunkChecksum form field (or Digest header) the client sent along with it.  Chunks are only
+// checked when Server.HashFactory is set; otherwise the checksum is ignored.  Callers
+// exposing this over HTTP should map it to 460 (or plain 400, if they'd rather not use a
+// non-standard status).
+var ErrChunkChecksumMismatch = errors.New("gongflow: chunk checksum doesn't match flowChunkChecksum/Digest")
+
+// linkableStore is an optional ChunkStore capability that lets Server short-circuit assembling an
+// upload whose root digest it's already seen, by linking (or copying) the existing final file to
+// the new upload's path instead of rewriting it from chunks.
+type linkableStore interface {
+	LinkAssembled(existingPath, id, filename string) (string, error)
+}
+
+// digests tracks the per-chunk digests of in-progress uploads, so Server can combine them into a
+// root digest once every chunk has arrived without re-reading (and re-hashing) them from the
+// store.  It only ever lives as long as the upload is in progress, and like the assembling and
+// tusUploads maps it's per-Server-instance: a deployment spreading one upload's chunks across
+// several Server instances would need this persisted in the store itself to dedupe correctly.
+type digests struct {
+	mu   sync.Mutex
+	byID map[string]map[int]string
+}
+
+func newDigests() *digests {
+	return &digests{byID: make(map[string]map[int]string)}
+}
+
+func (d *digests) record(identifier string, n int, digest string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.byID[identifier] == nil {
+		d.byID[identifier] = make(map[int]string)
+	}
+	d.byID[identifier][n] = digest
+}
+
+func (d *digests) get(identifier string, n int) (string, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	digest, ok := d.byID[identifier][n]
+	return digest, ok
+}
+
+func (d *digests) forget(identifier string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.byID, identifier)
+}
+
+// Lookup returns the path of an already-assembled file whose root digest is digest, if Server has
+// seen one, so callers can implement upload-avoidance ("this file already exists, skip") before a
+// client even starts uploading.
+func (s *Server) Lookup(digest string) (string, bool) {
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	finalPath, ok := s.roots[digest]
+	return finalPath, ok
+}
+
+func (s *Server) recordRoot(digest, finalPath string) {
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	s.roots[digest] = finalPath
+}
+
+func (s *Server) forgetRoot(digest string) {
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	delete(s.roots, digest)
+}
+
+// forgetRootsUnder drops every root digest recorded for a file under identifier, once
+// ChunksCleanup/DeleteUpload has removed that file -- otherwise a later upload with the same
+// content would hit a stale Lookup pointing at nothing (see assembleWithDedup).
+func (s *Server) forgetRootsUnder(identifier string) {
+	s.rootsMu.Lock()
+	defer s.rootsMu.Unlock()
+	for digest, finalPath := range s.roots {
+		// every store puts an upload's final file directly in the upload's own directory or
+		// prefix (e.g. TempDir/identifier/filename), so its parent's base name is identifier.
+		if filepath.Base(filepath.Dir(finalPath)) == identifier {
+			delete(s.roots, digest)
+		}
+	}
+}
+
+// hashChunk wraps r in a TeeReader that feeds s.HashFactory while the caller streams r into the
+// store, so the chunk is hashed for free as it's written rather than read back afterwards. It
+// also returns a function that, once the write is done, both yields the hex digest and (if
+// wantChecksum is non-empty) verifies it, returning ErrChunkChecksumMismatch on disagreement.
+func (s *Server) hashChunk(r io.Reader) (io.Reader, func(wantChecksum string) (string, error)) {
+	if s.HashFactory == nil {
+		return r, func(string) (string, error) { return "", nil }
+	}
+	h := s.HashFactory()
+	tee := io.TeeReader(r, h)
+	return tee, func(wantChecksum string) (string, error) {
+		digest := hex.EncodeToString(h.Sum(nil))
+		if wantChecksum != "" && wantChecksum != digest {
+			return "", ErrChunkChecksumMismatch
+		}
+		return digest, nil
+	}
+}
+
+// chunkChecksum extracts the checksum a client sent for a chunk, preferring the Digest header
+// (the generic HTTP mechanism) over ng-flow's own flowChunkChecksum form field.
+func chunkChecksum(r *http.Request) string {
+	if d := r.Header.Get("Digest"); d != "" {
+		return d
+	}
+	return r.FormValue("flowChunkChecksum")
+}
+
+// rootDigest combines the digests of chunks 1..totalChunks of identifier, in order, into a single
+// Merkle-style digest identifying the assembled file as a whole.
+func (s *Server) rootDigest(identifier string, totalChunks int) (string, error) {
+	h := s.HashFactory()
+	for n := 1; n <= totalChunks; n++ {
+		digest, ok := s.chunkDigests.get(identifier, n)
+		if !ok {
+			return "", errors.New("gongflow: missing digest for chunk " + strconv.Itoa(n) + " of " + identifier)
+		}
+		raw, err := hex.DecodeString(digest)
+		if err != nil {
+			return "", err
+		}
+		h.Write(raw)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// assembleWithDedup assembles identifier under filename, short-circuiting to a hard link (or
+// copy) of an existing final file when its root digest has already been seen. Hashing must be
+// enabled (s.HashFactory != nil); the caller holds the assembly lock for identifier.
+func (s *Server) assembleWithDedup(identifier, filename string, totalChunks int) (finalPath string, root string, err error) {
+	defer s.chunkDigests.forget(identifier)
+
+	root, err = s.rootDigest(identifier, totalChunks)
+	if err != nil {
+		return "", "", err
+	}
+
+	if existing, ok := s.Lookup(root); ok {
+		if linker, ok := s.Store.(linkableStore); ok {
+			if finalPath, err = linker.LinkAssembled(existing, identifier, filename); err == nil {
+				return finalPath, root, nil
+			}
+			// existing no longer points at anything usable (e.g. it was cleaned up by
+			// ChunksCleanup/DeleteUpload since it was recorded) -- treat the stale Lookup hit as
+			// a cache miss and fall through to assembling identifier from scratch instead of
+			// failing its otherwise-complete upload.
+			s.forgetRoot(root)
+		}
+	}
+
+	finalPath, err = s.Store.Assemble(identifier, filename, totalChunks)
+	if err != nil {
+		return "", "", err
+	}
+	s.recordRoot(root, finalPath)
+	return finalPath, root, nil
+}
@@ -0,0 +1,114 @@
+package gongflow
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+// TestChunkUploadHashingProducesRootDigest checks that enabling HashFactory makes ChunkUpload
+// return a non-empty root digest alongside the assembled path, and that the same two chunks
+// always produce the same root digest.
+func TestChunkUploadHashingProducesRootDigest(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	s.HashFactory = sha256.New
+
+	ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 2, TotalSize: 10, Identifier: "hash-test", Filename: "hash.txt"}
+
+	if _, _, err := s.ChunkUpload(ngfd, newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 1, 2, 5, 10, []byte("hello"))); err != nil {
+		t.Fatalf("ChunkUpload (chunk 1): %v", err)
+	}
+	ngfd.ChunkNumber = 2
+	path, root, err := s.ChunkUpload(ngfd, newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 2, 2, 5, 10, []byte("world")))
+	if err != nil {
+		t.Fatalf("ChunkUpload (chunk 2): %v", err)
+	}
+	if path == "" || root == "" {
+		t.Fatalf("ChunkUpload = (%q, %q), want both non-empty once the upload completes", path, root)
+	}
+}
+
+// TestChunkUploadRejectsChecksumMismatch checks that a chunk sent with a wrong flowChunkChecksum
+// makes ChunkUpload fail with ErrChunkChecksumMismatch.
+func TestChunkUploadRejectsChecksumMismatch(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	s.HashFactory = sha256.New
+
+	ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 1, TotalSize: 5, Identifier: "checksum-test", Filename: "c.txt"}
+	req := newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 1, 1, 5, 5, []byte("hello"))
+	if err := req.ParseMultipartForm(32 << 20); err != nil {
+		t.Fatalf("ParseMultipartForm: %v", err)
+	}
+	req.Form.Set("flowChunkChecksum", "not-the-real-digest")
+
+	if _, _, err := s.ChunkUpload(ngfd, req); err != ErrChunkChecksumMismatch {
+		t.Fatalf("ChunkUpload with a bad flowChunkChecksum = %v, want ErrChunkChecksumMismatch", err)
+	}
+}
+
+// TestChunkUploadDedupsIdenticalContent checks that two uploads with identical chunk content
+// produce the same root digest and that the second one is served via Lookup/LinkAssembled
+// instead of being re-assembled from scratch.
+func TestChunkUploadDedupsIdenticalContent(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	s.HashFactory = sha256.New
+
+	upload := func(identifier string) (string, string) {
+		ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 1, TotalSize: 5, Identifier: identifier, Filename: "d.txt"}
+		path, root, err := s.ChunkUpload(ngfd, newChunkUploadRequest(t, identifier, ngfd.Filename, 1, 1, 5, 5, []byte("hello")))
+		if err != nil {
+			t.Fatalf("ChunkUpload(%s): %v", identifier, err)
+		}
+		return path, root
+	}
+
+	firstPath, firstRoot := upload("dedup-one")
+	secondPath, secondRoot := upload("dedup-two")
+
+	if firstRoot != secondRoot {
+		t.Fatalf("root digests differ for identical content: %q vs %q", firstRoot, secondRoot)
+	}
+
+	data, ok := store.ReadFinal(secondPath)
+	if !ok || string(data) != "hello" {
+		t.Fatalf("ReadFinal(%q) = (%q, %v), want (\"hello\", true)", secondPath, data, ok)
+	}
+	if foundPath, ok := s.Lookup(firstRoot); !ok || foundPath != firstPath {
+		t.Fatalf("Lookup(%q) = (%q, %v), want (%q, true)", firstRoot, foundPath, ok, firstPath)
+	}
+}
+
+// TestChunkUploadAssemblesAfterDedupTargetDeleted checks that a stale Lookup hit -- one whose
+// final file was since removed by DeleteUpload/ChunksCleanup -- is treated as a cache miss
+// instead of failing the otherwise-complete upload that found it.
+func TestChunkUploadAssemblesAfterDedupTargetDeleted(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	s.HashFactory = sha256.New
+
+	upload := func(identifier string) (string, string, error) {
+		ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 1, TotalSize: 5, Identifier: identifier, Filename: "a.txt"}
+		return s.ChunkUpload(ngfd, newChunkUploadRequest(t, identifier, ngfd.Filename, 1, 1, 5, 5, []byte("hello")))
+	}
+
+	if _, _, err := upload("first"); err != nil {
+		t.Fatalf("ChunkUpload(first): %v", err)
+	}
+	if err := store.DeleteUpload("first"); err != nil {
+		t.Fatalf("DeleteUpload(first): %v", err)
+	}
+
+	path, _, err := upload("second")
+	if err != nil {
+		t.Fatalf("ChunkUpload(second): %v", err)
+	}
+	if path == "" {
+		t.Fatalf("ChunkUpload(second) = empty path, want the upload to assemble from scratch")
+	}
+	data, ok := store.ReadFinal(path)
+	if !ok || string(data) != "hello" {
+		t.Fatalf("ReadFinal(%q) = (%q, %v), want (\"hello\", true)", path, data, ok)
+	}
+}
@@ -0,0 +1,336 @@
+package gongflow
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+var (
+	// ErrNoTempDir is returned when the temp directory doesn't exist
+	ErrNoTempDir = errors.New("gongflow: the temporary directory doesn't exist")
+	// ErrCantCreateDir is returned when it can't create a directory under the temp directory
+	ErrCantCreateDir = errors.New("gongflow: can't create a directory under the temp directory")
+	// ErrCantWriteFile is returned when it can't write to a file under the temp directory
+	ErrCantWriteFile = errors.New("gongflow: can't write to a file under the temp directory")
+	// ErrCantReadFile is returned when it can't read a file under the temp directory (or got back bad data)
+	ErrCantReadFile = errors.New("gongflow: can't read a file under the temp directory (or got back bad data)")
+	// ErrCantDelete is return when it can't delete a file/directory under the temp directory
+	ErrCantDelete = errors.New("gongflow: can't delete a file/directory under the temp directory")
+)
+
+// chunkBufferPool hands out reusable byte slices for copying chunk data to/from disk, so
+// storing or assembling a chunk doesn't need to hold the whole chunk in memory at once.
+var chunkBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// FSStore is a ChunkStore backed by a directory on the local filesystem: one sub-directory per
+// upload identifier, and one file per chunk.  This is the storage gongflow has always used.
+type FSStore struct {
+	// TempDir is the directory every upload gets a sub-directory under.
+	TempDir string
+
+	checkOnce sync.Once
+	checkErr  error
+}
+
+// NewFSStore returns a ChunkStore that keeps every upload's chunks under tempDir.
+func NewFSStore(tempDir string) *FSStore {
+	return &FSStore{TempDir: tempDir}
+}
+
+func (s *FSStore) uploadDir(id string) (string, error) {
+	return secureJoin(s.TempDir, id)
+}
+
+func (s *FSStore) chunkPath(id string, n int) (string, error) {
+	dir, err := s.uploadDir(id)
+	if err != nil {
+		return "", err
+	}
+	return secureJoin(dir, strconv.Itoa(n))
+}
+
+// WriteChunk streams r into chunk n of the upload identified by id.
+func (s *FSStore) WriteChunk(id string, n int, r io.Reader, size int64) error {
+	if err := s.checkDirectory(); err != nil {
+		return err
+	}
+
+	dir, err := s.uploadDir(id)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dir, DefaultDirPermissions); err != nil {
+		return errors.New("Bad directory")
+	}
+
+	chunkFile, err := s.chunkPath(id, n)
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(chunkFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, DefaultFilePermissions)
+	if err != nil {
+		return errors.New("Can't write file")
+	}
+	defer dst.Close()
+
+	buf := chunkBufferPool.Get().(*[]byte)
+	defer chunkBufferPool.Put(buf)
+
+	if _, err = io.CopyBuffer(dst, r, *buf); err != nil {
+		return errors.New("Can't write file")
+	}
+	return nil
+}
+
+// ChunkInfo reports the size of chunk n of the upload identified by id.
+func (s *FSStore) ChunkInfo(id string, n int) (int64, bool, error) {
+	if err := s.checkDirectory(); err != nil {
+		return 0, false, err
+	}
+	chunkFile, err := s.chunkPath(id, n)
+	if err != nil {
+		return 0, false, err
+	}
+	finfo, err := os.Stat(chunkFile)
+	if err != nil {
+		return 0, false, nil
+	}
+	return finfo.Size(), true, nil
+}
+
+// ReadChunk opens chunk n of the upload identified by id for reading, implementing the optional
+// chunkReader capability the tus Concatenation extension uses.
+func (s *FSStore) ReadChunk(id string, n int) (io.ReadCloser, error) {
+	chunkFile, err := s.chunkPath(id, n)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(chunkFile)
+}
+
+// Assemble combines every chunk stored for id, in chunk-number order (sorted numerically, not
+// lexicographically, so chunk 10 doesn't land before chunk 2), into filename and returns the
+// resulting path.
+func (s *FSStore) Assemble(id, filename string, totalChunks int) (string, error) {
+	dir, err := s.uploadDir(id)
+	if err != nil {
+		return "", err
+	}
+	combinedName, err := secureJoin(dir, filename)
+	if err != nil {
+		return "", err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	var chunkNumbers []int
+	for _, f := range files {
+		// the directory listing contains the combined file name too, once it exists; skip it.
+		if path.Join(dir, f.Name()) == combinedName {
+			continue
+		}
+		n, err := strconv.Atoi(f.Name())
+		if err != nil {
+			continue
+		}
+		chunkNumbers = append(chunkNumbers, n)
+	}
+	sort.Ints(chunkNumbers)
+	if !contiguousChunks(chunkNumbers, totalChunks) {
+		return "", ErrIncompleteUpload
+	}
+
+	cn, err := os.OpenFile(combinedName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, DefaultFilePermissions)
+	if err != nil {
+		return "", err
+	}
+	defer cn.Close()
+
+	buf := chunkBufferPool.Get().(*[]byte)
+	defer chunkBufferPool.Put(buf)
+
+	for _, n := range chunkNumbers {
+		fl := path.Join(dir, strconv.Itoa(n))
+		if err = func() error {
+			src, err := os.Open(fl)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.CopyBuffer(cn, src, *buf)
+			return err
+		}(); err != nil {
+			return "", err
+		}
+		if err = os.Remove(fl); err != nil {
+			return "", err
+		}
+	}
+
+	return combinedName, nil
+}
+
+// LinkAssembled places the already-assembled file at existingPath at id/filename instead of
+// recombining id's chunks from scratch, implementing the optional linkableStore capability Server
+// uses for content-addressable dedup. It prefers a hard link, falling back to a copy when
+// existingPath is on a different filesystem (or the filesystem doesn't support hard links), and
+// removes id's now-redundant chunk files same as Assemble would.
+func (s *FSStore) LinkAssembled(existingPath, id, filename string) (string, error) {
+	dir, err := s.uploadDir(id)
+	if err != nil {
+		return "", err
+	}
+	if err = os.MkdirAll(dir, DefaultDirPermissions); err != nil {
+		return "", errors.New("Bad directory")
+	}
+	target, err := secureJoin(dir, filename)
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.Link(existingPath, target); err != nil {
+		if err = copyFile(existingPath, target); err != nil {
+			return "", err
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if path.Join(dir, f.Name()) == target {
+			continue
+		}
+		if err = os.Remove(path.Join(dir, f.Name())); err != nil {
+			return "", err
+		}
+	}
+
+	return target, nil
+}
+
+// copyFile copies src to dst, used as LinkAssembled's fallback when a hard link isn't possible.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, DefaultFilePermissions)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	buf := chunkBufferPool.Get().(*[]byte)
+	defer chunkBufferPool.Put(buf)
+
+	_, err = io.CopyBuffer(out, in, *buf)
+	return err
+}
+
+// DeleteUpload removes every chunk (and any assembled file) stored for id.
+func (s *FSStore) DeleteUpload(id string) error {
+	dir, err := s.uploadDir(id)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// ListUploads returns every upload currently sitting under TempDir.
+func (s *FSStore) ListUploads() ([]UploadInfo, error) {
+	files, err := ioutil.ReadDir(s.TempDir)
+	if err != nil {
+		return nil, err
+	}
+	uploads := make([]UploadInfo, 0, len(files))
+	for _, f := range files {
+		uploads = append(uploads, UploadInfo{Identifier: f.Name(), ModTime: f.ModTime()})
+	}
+	return uploads, nil
+}
+
+// checkDirectory makes sure that we have all the needed permissions to the temp directory to
+// read/write/delete.  Expensive operation, so each FSStore only does it once, the first time
+// it's asked -- re-creating an FSStore (as tests that use a fresh per-test temp dir do) gets its
+// own independent check instead of being stuck with whatever an earlier instance found.
+func (s *FSStore) checkDirectory() error {
+	s.checkOnce.Do(func() {
+		s.checkErr = checkDirectoryPermissions(s.TempDir)
+	})
+	return s.checkErr
+}
+
+// checkDirectoryPermissions does the actual read/write/delete probe of d.
+func checkDirectoryPermissions(d string) error {
+	if !directoryExists(d) {
+		return ErrNoTempDir
+	}
+
+	testName := "5d58061677944334bb616ba19cec5cc4"
+	testChunk := "42"
+	contentName := "foobie"
+	testContent := `For instance, on the planet Earth, man had always assumed that he was more intelligent than
+	dolphins because he had achieved so much—the wheel, New York, wars and so on—whilst all the dolphins had
+	ever done was muck about in the water having a good time. But conversely, the dolphins had always believed
+	that they were far more intelligent than man—for precisely the same reasons.`
+
+	p := path.Join(d, testName, testChunk)
+	err := os.MkdirAll(p, DefaultDirPermissions)
+	if err != nil {
+		return ErrCantCreateDir
+	}
+
+	f := path.Join(p, contentName)
+	err = ioutil.WriteFile(f, []byte(testContent), DefaultFilePermissions)
+	if err != nil {
+		return ErrCantWriteFile
+	}
+
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return ErrCantReadFile
+	}
+	if string(b) != testContent {
+		return ErrCantReadFile // TODO: This should probably be a different error
+	}
+
+	err = os.RemoveAll(path.Join(d, testName))
+	if err != nil {
+		return ErrCantDelete
+	}
+
+	if os.TempDir() == d {
+		log.Println("You should really have a directory just for upload temp (different from system temp).  It is OK, but consider making a subdirectory for it.")
+	}
+
+	return nil
+}
+
+// directoryExists checks if the directory exists of course!
+func directoryExists(d string) bool {
+	finfo, err := os.Stat(d)
+
+	if err == nil && finfo.IsDir() {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package gongflow
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// maxSteadyStateAllocBytes is the ceiling we expect heap usage to stay under while streaming
+// chunks, regardless of how large the file being uploaded is.  It is generous on purpose (a
+// handful of chunk-sized buffers), it's only meant to catch a regression back to buffering
+// whole chunks (or the whole file) in memory.
+const maxSteadyStateAllocBytes = 64 * 1024 * 1024
+
+// BenchmarkChunkUploadLargeFile uploads a 1 GiB file in 5 MiB chunks and asserts that memory
+// usage stays bounded instead of growing with the size of the file being uploaded.
+func BenchmarkChunkUploadLargeFile(b *testing.B) {
+	const (
+		chunkSize  = 5 * 1024 * 1024
+		totalSize  = 1024 * 1024 * 1024
+		totalChunk = totalSize / chunkSize
+	)
+
+	tempDir, err := ioutil.TempDir("", "gongflow-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	server := NewServer(NewFSStore(tempDir))
+
+	chunk := make([]byte, chunkSize)
+	// totalSize isn't a whole number of chunks; as ng-flow does, the last chunk carries the
+	// remainder on top of a full chunk.
+	lastChunk := make([]byte, chunkSize+totalSize%chunkSize)
+
+	for i := 0; i < b.N; i++ {
+		identifier := fmt.Sprintf("bench-%d", i)
+
+		var peakAlloc uint64
+		for n := 1; n <= totalChunk; n++ {
+			data := chunk
+			if n == totalChunk {
+				data = lastChunk
+			}
+			req := newChunkUploadRequest(b, identifier, "bigfile.bin", n, totalChunk, chunkSize, totalSize, data)
+
+			ngfd, err := ChunkFlowData(req)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := server.ChunkUpload(ngfd, req); err != nil {
+				b.Fatal(err)
+			}
+
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			if ms.HeapAlloc > peakAlloc {
+				peakAlloc = ms.HeapAlloc
+			}
+		}
+
+		if peakAlloc > maxSteadyStateAllocBytes {
+			b.Fatalf("heap grew to %d bytes while uploading a %d byte file in %d byte chunks; expected it to stay bounded", peakAlloc, totalSize, chunkSize)
+		}
+	}
+}
+
+// newChunkUploadRequest builds a multipart POST request equivalent to what ng-flow sends for a
+// single chunk.
+func newChunkUploadRequest(tb testing.TB, identifier, filename string, chunkNumber, totalChunks, chunkSize, totalSize int, data []byte) *http.Request {
+	tb.Helper()
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	fields := map[string]string{
+		"flowChunkNumber":  fmt.Sprintf("%d", chunkNumber),
+		"flowTotalChunks":  fmt.Sprintf("%d", totalChunks),
+		"flowChunkSize":    fmt.Sprintf("%d", chunkSize),
+		"flowTotalSize":    fmt.Sprintf("%d", totalSize),
+		"flowIdentifier":   identifier,
+		"flowFilename":     filename,
+		"flowRelativePath": filename,
+	}
+	for k, v := range fields {
+		if err := w.WriteField(k, v); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	part, err := w.CreateFormFile("file", filename)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err = io.Copy(part, bytes.NewReader(data)); err != nil {
+		tb.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		tb.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
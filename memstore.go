@@ -0,0 +1,147 @@
+package gongflow
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemStore is a ChunkStore that keeps every chunk in memory instead of touching disk, so tests
+// can exercise ChunkUpload/ChunkStatus/ChunksCleanup without a real filesystem.  It is not meant
+// for production use.
+type MemStore struct {
+	mu      sync.Mutex
+	chunks  map[string]map[int][]byte
+	modTime map[string]time.Time
+	finals  map[string][]byte
+}
+
+// NewMemStore returns an empty in-memory ChunkStore.
+func NewMemStore() *MemStore {
+	return &MemStore{
+		chunks:  make(map[string]map[int][]byte),
+		modTime: make(map[string]time.Time),
+		finals:  make(map[string][]byte),
+	}
+}
+
+// WriteChunk stores chunk n of the upload identified by id in memory.
+func (s *MemStore) WriteChunk(id string, n int, r io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return errors.New("Can't read file")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.chunks[id] == nil {
+		s.chunks[id] = make(map[int][]byte)
+	}
+	s.chunks[id][n] = data
+	s.modTime[id] = time.Now()
+	return nil
+}
+
+// ChunkInfo reports the size of chunk n of the upload identified by id.
+func (s *MemStore) ChunkInfo(id string, n int) (int64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.chunks[id][n]
+	if !ok {
+		return 0, false, nil
+	}
+	return int64(len(data)), true, nil
+}
+
+// ReadChunk opens chunk n of the upload identified by id for reading, implementing the optional
+// chunkReader capability the tus Concatenation extension uses.
+func (s *MemStore) ReadChunk(id string, n int) (io.ReadCloser, error) {
+	s.mu.Lock()
+	data, ok := s.chunks[id][n]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.New("gongflow: chunk not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Assemble combines every chunk stored for id, in chunk-number order, and keeps the result in
+// memory under id/filename.  Use ReadFinal to retrieve the assembled bytes.
+func (s *MemStore) Assemble(id, filename string, totalChunks int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chunks := s.chunks[id]
+	numbers := make([]int, 0, len(chunks))
+	for n := range chunks {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	if !contiguousChunks(numbers, totalChunks) {
+		return "", ErrIncompleteUpload
+	}
+
+	var buf bytes.Buffer
+	for _, n := range numbers {
+		buf.Write(chunks[n])
+	}
+
+	finalPath := path.Join(id, filename)
+	s.finals[finalPath] = buf.Bytes()
+	delete(s.chunks, id)
+	return finalPath, nil
+}
+
+// LinkAssembled points id/filename at the same bytes already assembled at existingPath instead of
+// recombining id's chunks, implementing the optional linkableStore capability Server uses for
+// content-addressable dedup.
+func (s *MemStore) LinkAssembled(existingPath, id, filename string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.finals[existingPath]
+	if !ok {
+		return "", errors.New("gongflow: unknown final path " + existingPath)
+	}
+	finalPath := path.Join(id, filename)
+	s.finals[finalPath] = data
+	delete(s.chunks, id)
+	return finalPath, nil
+}
+
+// DeleteUpload removes every chunk (and any assembled file) stored for id.
+func (s *MemStore) DeleteUpload(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.chunks, id)
+	delete(s.modTime, id)
+	for finalPath := range s.finals {
+		if path.Dir(finalPath) == id {
+			delete(s.finals, finalPath)
+		}
+	}
+	return nil
+}
+
+// ListUploads returns every upload currently known to the store.
+func (s *MemStore) ListUploads() ([]UploadInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	uploads := make([]UploadInfo, 0, len(s.modTime))
+	for id, modTime := range s.modTime {
+		uploads = append(uploads, UploadInfo{Identifier: id, ModTime: modTime})
+	}
+	return uploads, nil
+}
+
+// ReadFinal returns the bytes assembled for finalPath (as returned by Assemble), for use in tests.
+func (s *MemStore) ReadFinal(finalPath string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.finals[finalPath]
+	return data, ok
+}
@@ -0,0 +1,104 @@
+package gongflow
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ErrUnsafePath is returned when a flowIdentifier or flowFilename from a request would cause a
+// chunk to be written outside of its own upload directory -- for example a flowIdentifier of
+// "../../etc" or a flowFilename containing a null byte.
+var ErrUnsafePath = errors.New("gongflow: identifier or filename would escape the upload directory")
+
+// identifierPattern is the strict charset every flowIdentifier must match.  ng-flow generates
+// identifiers itself (a hash of the file's size/name/time), so there's no legitimate reason for
+// one to contain path separators, "..", or anything else that isn't a single safe path component.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+// validateIdentifier rejects any flowIdentifier that isn't a single, safe path component.
+func validateIdentifier(id string) error {
+	if !identifierPattern.MatchString(id) {
+		return ErrUnsafePath
+	}
+	return nil
+}
+
+// validateFilename rejects any flowFilename that could be used to escape the directory it gets
+// joined into: absolute paths, "..", null bytes, or anything that isn't a single path component.
+func validateFilename(name string) error {
+	if name == "" || strings.ContainsRune(name, 0) {
+		return ErrUnsafePath
+	}
+	if filepath.IsAbs(name) {
+		return ErrUnsafePath
+	}
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return ErrUnsafePath
+	}
+	if filepath.Base(clean) != clean {
+		return ErrUnsafePath
+	}
+	return nil
+}
+
+// secureJoin joins elem onto base and verifies the result is still actually inside base once
+// ".." components and symlinks are resolved, returning ErrUnsafePath if it isn't.  This catches
+// what validateIdentifier/validateFilename can't: an existing directory entry that's a symlink
+// pointing outside of base.
+func secureJoin(base, elem string) (string, error) {
+	joined := filepath.Join(base, elem)
+
+	cleanBase, err := filepath.Abs(filepath.Clean(base))
+	if err != nil {
+		return "", err
+	}
+	cleanJoined, err := filepath.Abs(filepath.Clean(joined))
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(cleanBase, cleanJoined) {
+		return "", ErrUnsafePath
+	}
+
+	resolvedBase, err := resolveExisting(cleanBase)
+	if err != nil {
+		return "", err
+	}
+	resolvedJoined, err := resolveExisting(cleanJoined)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(resolvedBase, resolvedJoined) {
+		return "", ErrUnsafePath
+	}
+
+	return joined, nil
+}
+
+// withinDir reports whether path is dir itself or somewhere underneath it.
+func withinDir(dir, p string) bool {
+	return p == dir || strings.HasPrefix(p, dir+string(filepath.Separator))
+}
+
+// resolveExisting resolves symlinks in the longest existing prefix of p, since p (or its
+// trailing components) may not exist on disk yet -- a chunk's directory is created lazily.
+func resolveExisting(p string) (string, error) {
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return resolved, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p, nil
+		}
+		p = parent
+	}
+}
@@ -0,0 +1,84 @@
+package gongflow
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateIdentifierRejectsTraversal(t *testing.T) {
+	bad := []string{"../../etc", "..", "foo/bar", "foo\x00bar", "/etc/passwd", ""}
+	for _, id := range bad {
+		if err := validateIdentifier(id); err != ErrUnsafePath {
+			t.Errorf("validateIdentifier(%q) = %v, want ErrUnsafePath", id, err)
+		}
+	}
+
+	if err := validateIdentifier("a-valid_Identifier123"); err != nil {
+		t.Errorf("validateIdentifier on a valid identifier returned %v", err)
+	}
+}
+
+func TestValidateFilenameRejectsTraversal(t *testing.T) {
+	bad := []string{"../evil", "..", "foo/../../evil", "/etc/passwd", "foo\x00bar", ""}
+	for _, name := range bad {
+		if err := validateFilename(name); err != ErrUnsafePath {
+			t.Errorf("validateFilename(%q) = %v, want ErrUnsafePath", name, err)
+		}
+	}
+
+	if err := validateFilename("report.pdf"); err != nil {
+		t.Errorf("validateFilename on a valid filename returned %v", err)
+	}
+}
+
+func TestSecureJoinRejectsTraversal(t *testing.T) {
+	base, err := ioutil.TempDir("", "gongflow-securejoin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	cases := []string{"../escape", "../../etc/passwd", "a/../../escape"}
+	for _, elem := range cases {
+		if _, err := secureJoin(base, elem); err != ErrUnsafePath {
+			t.Errorf("secureJoin(%q, %q) = %v, want ErrUnsafePath", base, elem, err)
+		}
+	}
+}
+
+func TestSecureJoinRejectsSymlinkEscape(t *testing.T) {
+	base, err := ioutil.TempDir("", "gongflow-securejoin-base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	outside, err := ioutil.TempDir("", "gongflow-securejoin-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+
+	link := filepath.Join(base, "escape-link")
+	if err = os.Symlink(outside, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	if _, err := secureJoin(base, "escape-link/evil"); err != ErrUnsafePath {
+		t.Errorf("secureJoin through a symlink out of base = %v, want ErrUnsafePath", err)
+	}
+}
+
+func TestChunkFlowDataRejectsUnsafeIdentifierAndFilename(t *testing.T) {
+	req := newChunkUploadRequest(t, "../../etc", "report.pdf", 1, 1, 5, 5, []byte("hello"))
+	if _, err := ChunkFlowData(req); err != ErrUnsafePath {
+		t.Errorf("ChunkFlowData with unsafe identifier = %v, want ErrUnsafePath", err)
+	}
+
+	req = newChunkUploadRequest(t, "a-valid-id", "../evil.sh", 1, 1, 5, 5, []byte("hello"))
+	if _, err := ChunkFlowData(req); err != ErrUnsafePath {
+		t.Errorf("ChunkFlowData with unsafe filename = %v, want ErrUnsafePath", err)
+	}
+}
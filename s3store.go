@@ -0,0 +1,294 @@
+package gongflow
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// S3Store is a ChunkStore backed by an S3 bucket.  Each chunk is uploaded as its own object
+// under Prefix/id/n, and Assemble finalizes them into Prefix/id/filename using S3's multipart
+// upload API, so nothing is kept on the app server's disk; Assemble holds at most one group of
+// chunks in memory (see uploadPartFromChunks). This is what lets a gongflow deployment scale out across stateless instances instead of
+// needing sticky sessions to a single server's tempDir.
+type S3Store struct {
+	// Client is the S3 client uploads are made through.
+	Client *s3.Client
+	// Bucket is the bucket every chunk and assembled file is stored in.
+	Bucket string
+	// Prefix is prepended to every object key gongflow writes, so a bucket can be shared with
+	// other data.
+	Prefix string
+}
+
+// NewS3Store returns a ChunkStore backed by bucket, using client for every request.
+func NewS3Store(client *s3.Client, bucket, prefix string) *S3Store {
+	return &S3Store{Client: client, Bucket: bucket, Prefix: prefix}
+}
+
+func (s *S3Store) chunkKey(id string, n int) string {
+	return s.key(id, strconv.Itoa(n))
+}
+
+func (s *S3Store) key(id, name string) string {
+	if s.Prefix == "" {
+		return id + "/" + name
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + id + "/" + name
+}
+
+// WriteChunk uploads chunk n of the upload identified by id as its own S3 object.
+func (s *S3Store) WriteChunk(id string, n int, r io.Reader, size int64) error {
+	_, err := s.Client.PutObject(context.Background(), &s3.PutObjectInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(s.chunkKey(id, n)),
+		Body:          r,
+		ContentLength: size,
+	})
+	return err
+}
+
+// ChunkInfo reports the size of chunk n of the upload identified by id.
+func (s *S3Store) ChunkInfo(id string, n int) (int64, bool, error) {
+	out, err := s.Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(s.chunkKey(id, n)),
+	})
+	if err != nil {
+		return 0, false, nil
+	}
+	return out.ContentLength, true, nil
+}
+
+// s3MinPartSize is the smallest size S3 allows for every part of a multipart upload except the
+// last one.  ng-flow/tus chunks are routinely smaller than this (the repo's own tests use 5-byte
+// chunks; its benchmark's 5 MiB chunks sit exactly at the minimum), so Assemble can't always turn one chunk into one part via
+// UploadPartCopy -- see groupChunksIntoParts.
+const s3MinPartSize = 5 * 1024 * 1024
+
+// Assemble finalizes every chunk uploaded for id into a single object named filename, using an S3
+// multipart upload. Chunks are grouped by groupChunksIntoParts, since S3 would otherwise reject
+// small parts with EntityTooSmall. A group of one chunk is copied directly with UploadPartCopy; a
+// group of several is buffered in memory and uploaded as a single part. A chunk that is big
+// enough on its own still joins the group of a smaller chunk right before it.
+func (s *S3Store) Assemble(id, filename string, totalChunks int) (string, error) {
+	ctx := context.Background()
+	finalKey := s.key(id, filename)
+
+	created, err := s.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.Bucket),
+		Key:    aws.String(finalKey),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	numbers := make([]int, 0, totalChunks)
+	for n := 1; n <= totalChunks; n++ {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	sizes := make([]int64, len(numbers))
+	for i, n := range numbers {
+		size, ok, err := s.ChunkInfo(id, n)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", fmt.Errorf("gongflow: chunk %d of %s is missing", n, id)
+		}
+		sizes[i] = size
+	}
+
+	var parts []types.CompletedPart
+	for _, group := range groupChunksIntoParts(numbers, sizes, s3MinPartSize) {
+		partNumber := int32(len(parts) + 1)
+
+		var part types.CompletedPart
+		if len(group.numbers) == 1 {
+			copied, err := s.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+				Bucket:     aws.String(s.Bucket),
+				Key:        aws.String(finalKey),
+				UploadId:   created.UploadId,
+				PartNumber: partNumber,
+				CopySource: aws.String(fmt.Sprintf("%s/%s", s.Bucket, s.chunkKey(id, group.numbers[0]))),
+			})
+			if err != nil {
+				return "", err
+			}
+			part = types.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: partNumber}
+		} else {
+			part, err = s.uploadPartFromChunks(ctx, finalKey, *created.UploadId, partNumber, id, group.numbers, group.size)
+			if err != nil {
+				return "", err
+			}
+		}
+		parts = append(parts, part)
+	}
+
+	if _, err = s.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.Bucket),
+		Key:             aws.String(finalKey),
+		UploadId:        created.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		return "", err
+	}
+
+	// Only the chunk objects are removed: DeleteUpload would also delete finalKey, which lives
+	// under the same id/ prefix.
+	for _, n := range numbers {
+		if _, err = s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.chunkKey(id, n)),
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	return finalKey, nil
+}
+
+// chunkGroup is a run of consecutive chunk numbers destined to become a single multipart part.
+type chunkGroup struct {
+	numbers []int
+	size    int64
+}
+
+// groupChunksIntoParts splits numbers (with corresponding per-chunk sizes) into consecutive runs,
+// closing each run as soon as its combined size reaches minPartSize, so every run except possibly
+// the last is at least minPartSize and each run can become one valid S3 multipart part.
+func groupChunksIntoParts(numbers []int, sizes []int64, minPartSize int64) []chunkGroup {
+	var groups []chunkGroup
+	for i := 0; i < len(numbers); {
+		group := chunkGroup{numbers: []int{numbers[i]}, size: sizes[i]}
+		i++
+		for group.size < minPartSize && i < len(numbers) {
+			group.numbers = append(group.numbers, numbers[i])
+			group.size += sizes[i]
+			i++
+		}
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+// uploadPartFromChunks downloads and concatenates the chunks of id named in numbers (in order)
+// and uploads the result as multipart part partNumber, for a group of several chunks whose first
+// chunk is too small on its own to satisfy S3's per-part minimum via UploadPartCopy. The
+// concatenated data is buffered in memory (rather than streamed straight through from the
+// GetObject responses) because UploadPart needs a seekable body to compute its payload hash, which
+// an io.MultiReader over several non-seekable HTTP response bodies can't provide. The buffer holds
+// the whole group, which can include one chunk of any size (the one that brings the group up to
+// the minimum).
+func (s *S3Store) uploadPartFromChunks(ctx context.Context, finalKey, uploadID string, partNumber int32, id string, numbers []int, size int64) (types.CompletedPart, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	for _, n := range numbers {
+		obj, err := s.Client.GetObject(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    aws.String(s.chunkKey(id, n)),
+		})
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+		_, err = io.Copy(buf, obj.Body)
+		obj.Body.Close()
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+	}
+
+	uploaded, err := s.Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.Bucket),
+		Key:           aws.String(finalKey),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    partNumber,
+		Body:          bytes.NewReader(buf.Bytes()),
+		ContentLength: size,
+	})
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	return types.CompletedPart{ETag: uploaded.ETag, PartNumber: partNumber}, nil
+}
+
+// DeleteUpload removes every object stored under id's prefix: its chunks and any assembled file.
+func (s *S3Store) DeleteUpload(id string) error {
+	ctx := context.Background()
+	listed, err := s.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(s.key(id, "")),
+	})
+	if err != nil {
+		return err
+	}
+	for _, obj := range listed.Contents {
+		if _, err = s.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(s.Bucket),
+			Key:    obj.Key,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUploads returns every upload currently known to the store, based on the prefixes under
+// Prefix.  ModTime is the most recent LastModified of any chunk still sitting under that prefix,
+// so ChunksCleanup can actually tell an old upload from a fresh one -- CommonPrefixes (what a
+// delimited listing like this one groups uploads by) doesn't carry LastModified itself.
+func (s *S3Store) ListUploads() ([]UploadInfo, error) {
+	ctx := context.Background()
+	out, err := s.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.Bucket),
+		Prefix:    aws.String(s.Prefix),
+		Delimiter: aws.String("/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	uploads := make([]UploadInfo, 0, len(out.CommonPrefixes))
+	for _, p := range out.CommonPrefixes {
+		if p.Prefix == nil {
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, s.Prefix), "/")
+		modTime, err := s.lastModified(ctx, *p.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, UploadInfo{Identifier: id, ModTime: modTime})
+	}
+	return uploads, nil
+}
+
+// lastModified returns the most recent LastModified of any object under prefix, by listing it
+// without a delimiter (so every chunk under it is returned, not just the prefix itself).
+func (s *S3Store) lastModified(ctx context.Context, prefix string) (time.Time, error) {
+	out, err := s.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var latest time.Time
+	for _, obj := range out.Contents {
+		if obj.LastModified != nil && obj.LastModified.After(latest) {
+			latest = *obj.LastModified
+		}
+	}
+	return latest, nil
+}
@@ -0,0 +1,399 @@
+package gongflow
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// TestGroupChunksIntoParts covers the sizes that matter for S3's "every part but the last must be
+// at least 5MiB" rule: chunks already big enough to stand alone, chunks that need batching to
+// clear the minimum, and the exact boundary between the two.
+func TestGroupChunksIntoParts(t *testing.T) {
+	const minPartSize = 10
+
+	cases := []struct {
+		name    string
+		numbers []int
+		sizes   []int64
+		want    []chunkGroup
+	}{
+		{
+			name:    "every chunk already at the minimum",
+			numbers: []int{1, 2, 3},
+			sizes:   []int64{10, 10, 10},
+			want: []chunkGroup{
+				{numbers: []int{1}, size: 10},
+				{numbers: []int{2}, size: 10},
+				{numbers: []int{3}, size: 10},
+			},
+		},
+		{
+			name:    "every chunk under the minimum gets batched into one group",
+			numbers: []int{1, 2, 3},
+			sizes:   []int64{3, 3, 3},
+			want: []chunkGroup{
+				{numbers: []int{1, 2, 3}, size: 9},
+			},
+		},
+		{
+			// groupChunksIntoParts grows a group greedily once it's started (even past the
+			// minimum with a single chunk), so a small chunk pulls in everything after it up to
+			// and including the first chunk that gets the running total over the line.
+			name:    "a small chunk pulls in everything up to the chunk that crosses the minimum",
+			numbers: []int{1, 2, 3},
+			sizes:   []int64{3, 3, 10},
+			want: []chunkGroup{
+				{numbers: []int{1, 2, 3}, size: 16},
+			},
+		},
+		{
+			name:    "a group that lands exactly on the boundary stops growing",
+			numbers: []int{1, 2, 3, 4},
+			sizes:   []int64{4, 6, 1, 1},
+			want: []chunkGroup{
+				{numbers: []int{1, 2}, size: 10},
+				{numbers: []int{3, 4}, size: 2},
+			},
+		},
+		{
+			name:    "the last group is allowed to stay under the minimum",
+			numbers: []int{1, 2},
+			sizes:   []int64{10, 2},
+			want: []chunkGroup{
+				{numbers: []int{1}, size: 10},
+				{numbers: []int{2}, size: 2},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := groupChunksIntoParts(c.numbers, c.sizes, minPartSize)
+			if len(got) != len(c.want) {
+				t.Fatalf("groupChunksIntoParts() = %+v, want %+v", got, c.want)
+			}
+			for i := range got {
+				if got[i].size != c.want[i].size || !intsEqual(got[i].numbers, c.want[i].numbers) {
+					t.Fatalf("group %d = %+v, want %+v", i, got[i], c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func intsEqual(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeS3 is just enough of the S3 HTTP API for S3Store's WriteChunk/ChunkInfo/Assemble to run
+// against: single-object PUT/HEAD/GET/DELETE, a delimited/undelimited ListObjectsV2, and the
+// multipart upload trio (Create/UploadPart(Copy)/Complete).
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	parts   map[string]map[int32][]byte // uploadId -> partNumber -> data
+	nextID  int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: map[string][]byte{}, parts: map[string]map[int32][]byte{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	// The bucket name is the first path segment; S3Store always addresses bucket+key together in
+	// path-style, so strip it the same way a real S3 endpoint would.
+	if i := strings.Index(key, "/"); i >= 0 {
+		key = key[i+1:]
+	} else {
+		key = ""
+	}
+	q := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && q.Get("list-type") == "2":
+		f.listObjectsV2(w, q)
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.createMultipartUpload(w, key)
+	case r.Method == http.MethodPut && q.Has("partNumber") && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.uploadPartCopy(w, r, q)
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		f.uploadPart(w, r, q)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.completeMultipartUpload(w, r, key, q.Get("uploadId"))
+	case r.Method == http.MethodPut:
+		f.putObject(w, r, key)
+	case r.Method == http.MethodHead:
+		f.headObject(w, key)
+	case r.Method == http.MethodGet:
+		f.getObject(w, key)
+	case r.Method == http.MethodDelete:
+		f.mu.Lock()
+		delete(f.objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported request", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) putObject(w http.ResponseWriter, r *http.Request, key string) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f.mu.Lock()
+	f.objects[key] = data
+	f.mu.Unlock()
+	w.Header().Set("ETag", `"etag"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) headObject(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	data, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", time.Unix(0, 0).UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) getObject(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	data, ok := f.objects[key]
+	f.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (f *fakeS3) createMultipartUpload(w http.ResponseWriter, key string) {
+	f.mu.Lock()
+	f.nextID++
+	uploadID := "upload-" + strconv.Itoa(f.nextID)
+	f.parts[uploadID] = map[int32][]byte{}
+	f.mu.Unlock()
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, uploadID)
+}
+
+func (f *fakeS3) uploadPartCopy(w http.ResponseWriter, r *http.Request, q interface{ Get(string) string }) {
+	source := r.Header.Get("X-Amz-Copy-Source")
+	if i := strings.Index(source, "/"); i >= 0 {
+		source = source[i+1:]
+	}
+	partNumber, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	uploadID := r.URL.Query().Get("uploadId")
+
+	f.mu.Lock()
+	data := f.objects[source]
+	if f.parts[uploadID] == nil {
+		f.parts[uploadID] = map[int32][]byte{}
+	}
+	f.parts[uploadID][int32(partNumber)] = append([]byte(nil), data...)
+	f.mu.Unlock()
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<CopyPartResult><ETag>"etag-%d"</ETag><LastModified>%s</LastModified></CopyPartResult>`, partNumber, time.Unix(0, 0).UTC().Format(time.RFC3339))
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, q interface{ Get(string) string }) {
+	partNumber, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	uploadID := r.URL.Query().Get("uploadId")
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	if f.parts[uploadID] == nil {
+		f.parts[uploadID] = map[int32][]byte{}
+	}
+	f.parts[uploadID][int32(partNumber)] = data
+	f.mu.Unlock()
+
+	w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, partNumber))
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUploadXML struct {
+	Parts []struct {
+		PartNumber int32 `xml:"PartNumber"`
+	} `xml:"Part"`
+}
+
+func (f *fakeS3) completeMultipartUpload(w http.ResponseWriter, r *http.Request, key, uploadID string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var parsed completeMultipartUploadXML
+	if err = xml.Unmarshal(body, &parsed); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	f.mu.Lock()
+	parts := f.parts[uploadID]
+	var buf bytes.Buffer
+	for _, p := range parsed.Parts {
+		buf.Write(parts[p.PartNumber])
+	}
+	f.objects[key] = buf.Bytes()
+	delete(f.parts, uploadID)
+	f.mu.Unlock()
+
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"etag"</ETag></CompleteMultipartUploadResult>`, key)
+}
+
+func (f *fakeS3) listObjectsV2(w http.ResponseWriter, q interface{ Get(string) string }) {
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?><ListBucketResult>`)
+	if delimiter == "" {
+		for _, k := range keys {
+			fmt.Fprintf(&buf, `<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+				k, time.Unix(0, 0).UTC().Format(time.RFC3339), len(f.objects[k]))
+		}
+	} else {
+		seen := map[string]bool{}
+		for _, k := range keys {
+			rest := strings.TrimPrefix(k, prefix)
+			if i := strings.Index(rest, delimiter); i >= 0 {
+				common := prefix + rest[:i+len(delimiter)]
+				if !seen[common] {
+					seen[common] = true
+					fmt.Fprintf(&buf, `<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>`, common)
+				}
+				continue
+			}
+			fmt.Fprintf(&buf, `<Contents><Key>%s</Key><LastModified>%s</LastModified><Size>%d</Size></Contents>`,
+				k, time.Unix(0, 0).UTC().Format(time.RFC3339), len(f.objects[k]))
+		}
+	}
+	buf.WriteString(`</ListBucketResult>`)
+	w.Write(buf.Bytes())
+}
+
+// newTestS3Store returns an S3Store wired up against an in-process fakeS3 server, closed
+// automatically when the test ends.
+func newTestS3Store(t *testing.T) *S3Store {
+	t.Helper()
+	backend := newFakeS3()
+	server := httptest.NewServer(backend)
+	t.Cleanup(server.Close)
+
+	client := s3.New(s3.Options{
+		Region: "us-east-1",
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		UsePathStyle:     true,
+		EndpointResolver: s3.EndpointResolverFromURL(server.URL),
+	})
+	return NewS3Store(client, "bucket", "")
+}
+
+// TestS3StoreWriteChunkAndAssembleSmallChunks exercises S3Store end to end against a fake S3
+// backend with chunks well under s3MinPartSize, the exact scenario that used to fail with
+// EntityTooSmall before Assemble learned to batch them (see groupChunksIntoParts).
+func TestS3StoreWriteChunkAndAssembleSmallChunks(t *testing.T) {
+	store := newTestS3Store(t)
+
+	chunks := []string{"hello ", "world"}
+	for i, content := range chunks {
+		if err := store.WriteChunk("upload-1", i+1, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("WriteChunk(%d): %v", i+1, err)
+		}
+	}
+
+	for i, content := range chunks {
+		size, ok, err := store.ChunkInfo("upload-1", i+1)
+		if err != nil || !ok || size != int64(len(content)) {
+			t.Fatalf("ChunkInfo(%d) = (%d, %v, %v), want (%d, true, nil)", i+1, size, ok, err, len(content))
+		}
+	}
+
+	finalPath, err := store.Assemble("upload-1", "greeting.txt", len(chunks))
+	if err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	if finalPath != "upload-1/greeting.txt" {
+		t.Fatalf("Assemble finalPath = %q, want %q", finalPath, "upload-1/greeting.txt")
+	}
+
+	if _, ok, _ := store.ChunkInfo("upload-1", 1); ok {
+		t.Fatalf("chunk 1 still exists after Assemble, want it deleted along with the rest of the upload")
+	}
+}
+
+// TestS3StoreListUploadsReportsRealLastModified checks ListUploads surfaces the real
+// LastModified of an upload's chunks rather than the moment ListUploads happened to be called, so
+// ChunksCleanup's age check actually has something meaningful to compare against.
+func TestS3StoreListUploadsReportsRealLastModified(t *testing.T) {
+	store := newTestS3Store(t)
+
+	if err := store.WriteChunk("upload-2", 1, strings.NewReader("x"), 1); err != nil {
+		t.Fatalf("WriteChunk: %v", err)
+	}
+
+	uploads, err := store.ListUploads()
+	if err != nil {
+		t.Fatalf("ListUploads: %v", err)
+	}
+	if len(uploads) != 1 || uploads[0].Identifier != "upload-2" {
+		t.Fatalf("ListUploads = %+v, want a single upload-2 entry", uploads)
+	}
+	if !uploads[0].ModTime.Equal(time.Unix(0, 0).UTC()) {
+		t.Fatalf("ListUploads ModTime = %v, want the chunk's real LastModified (%v), not time.Now()", uploads[0].ModTime, time.Unix(0, 0).UTC())
+	}
+}
@@ -0,0 +1,193 @@
+package gongflow
+
+import (
+	"errors"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Server ties a ChunkStore to the ng-flow and tus.io handlers, and owns everything about a
+// deployment that used to live in package-level state: which store uploads go to, where to log,
+// and the locks needed to assemble an upload safely when two requests finish it at once.
+type Server struct {
+	// Store is where chunks are written, checked on, and assembled.
+	Store ChunkStore
+	// Logger is used for the occasional operational log line (e.g. from ChunksCleanup).  If nil,
+	// the standard library's default logger is used.
+	Logger *log.Logger
+	// HashFactory, if non-nil, turns on content-addressable hashing: every chunk ChunkUpload
+	// receives is hashed as it streams to the store, and the per-chunk digests are combined into
+	// a Merkle-style root digest for the assembled file once an upload completes. Leave nil (the
+	// default) to disable hashing and dedup entirely.
+	HashFactory func() hash.Hash
+
+	assembleMu sync.Mutex
+	assembling map[string]*sync.Mutex
+
+	tusMu      sync.Mutex
+	tusUploads map[string]*tusUpload
+
+	chunkDigests *digests
+
+	rootsMu sync.Mutex
+	roots   map[string]string // root digest -> finalPath of an already-assembled file
+}
+
+// NewServer returns a Server that stores uploads in store.
+func NewServer(store ChunkStore) *Server {
+	return &Server{
+		Store:        store,
+		assembling:   make(map[string]*sync.Mutex),
+		tusUploads:   make(map[string]*tusUpload),
+		chunkDigests: newDigests(),
+		roots:        make(map[string]string),
+	}
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// ChunkUpload is used to handle a POST from ng-flow, it will return an empty string for chunk upload (incomplete) and when
+// all the chunks have been uploaded, it will return the path to the reconstituted file.  So, you can just keep calling it
+// until you get back the path to a file. When HashFactory is set, it also returns the root digest of the assembled file
+// (empty until the upload completes), and rejects a chunk with ErrChunkChecksumMismatch if it doesn't match the client's
+// flowChunkChecksum/Digest.
+func (s *Server) ChunkUpload(ngfd NgFlowData, r *http.Request) (string, string, error) {
+	if err := validateIdentifier(ngfd.Identifier); err != nil {
+		return "", "", ErrUnsafePath
+	}
+	if err := validateFilename(ngfd.Filename); err != nil {
+		return "", "", ErrUnsafePath
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return "", "", errors.New("Unable to store chunk" + "Can't access file field")
+	}
+	defer file.Close()
+
+	reader, digestOf := s.hashChunk(file)
+	if err = s.Store.WriteChunk(ngfd.Identifier, ngfd.ChunkNumber, reader, header.Size); err != nil {
+		return "", "", errors.New("Unable to store chunk" + err.Error())
+	}
+	digest, err := digestOf(chunkChecksum(r))
+	if err != nil {
+		return "", "", err
+	}
+	if s.HashFactory != nil {
+		s.chunkDigests.record(ngfd.Identifier, ngfd.ChunkNumber, digest)
+	}
+
+	uploaded, err := allChunksUploaded(s.Store, ngfd)
+	if err != nil {
+		return "", "", err
+	}
+	if !uploaded {
+		return "", "", nil
+	}
+
+	// Two concurrent requests can both land the last chunk and both observe allChunksUploaded
+	// == true; without serializing here they'd race in Store.Assemble and could produce a
+	// corrupted or duplicated final file.  Only one goroutine per identifier gets to assemble.
+	lock := s.assemblyLock(ngfd.Identifier)
+	// identifier is done with once we're through here (assembled by us or found already
+	// assembled below), so drop its entry instead of keeping it around for the life of the
+	// Server -- registered before the lock.Unlock() defer so it runs after the unlock, not
+	// before it (deferred calls run in LIFO order).
+	defer s.forgetAssembly(ngfd.Identifier)
+	lock.Lock()
+	defer lock.Unlock()
+
+	uploaded, err = allChunksUploaded(s.Store, ngfd)
+	if err != nil {
+		return "", "", err
+	}
+	if !uploaded {
+		// someone else already assembled (and deleted) the chunks while we waited for the lock.
+		return "", "", nil
+	}
+
+	if s.HashFactory == nil {
+		finalPath, err := s.Store.Assemble(ngfd.Identifier, ngfd.Filename, ngfd.TotalChunks)
+		return finalPath, "", err
+	}
+	finalPath, root, err := s.assembleWithDedup(ngfd.Identifier, ngfd.Filename, ngfd.TotalChunks)
+	return finalPath, root, err
+}
+
+// assemblyLock returns the mutex that guards assembling identifier, creating one if this is the
+// first time it's been seen.
+func (s *Server) assemblyLock(identifier string) *sync.Mutex {
+	s.assembleMu.Lock()
+	defer s.assembleMu.Unlock()
+	lock, ok := s.assembling[identifier]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.assembling[identifier] = lock
+	}
+	return lock
+}
+
+// forgetAssembly drops identifier's entry from assembling once it'll never be locked again, so
+// the map doesn't grow for the life of the Server.
+func (s *Server) forgetAssembly(identifier string) {
+	s.assembleMu.Lock()
+	defer s.assembleMu.Unlock()
+	delete(s.assembling, identifier)
+}
+
+// ChunkStatus is used to handle a GET from ng-flow, it will return a (message, 200) for when it already has a chunk, and it
+// will return a (message, 406 | 500) when a chunk is incomplete or not started.
+func (s *Server) ChunkStatus(ngfd NgFlowData) (string, int) {
+	ChunkNumberString := strconv.Itoa(ngfd.ChunkNumber)
+	size, ok, err := s.Store.ChunkInfo(ngfd.Identifier, ngfd.ChunkNumber)
+	if err != nil {
+		return "Directory is broken: " + err.Error(), http.StatusInternalServerError
+	}
+	if !ok {
+		// every thing except for 200, 201, 202, 404, 415. 500, 501
+		return "The chunk " + ngfd.Identifier + ":" + ChunkNumberString + " isn't started yet!", http.StatusNotAcceptable
+	}
+	// An exception for large last chunks, according to ng-flow the last chunk can be anywhere less
+	// than 2x the chunk size unless you haave forceChunkSize on... seems like idiocy to me, but alright.
+	if ngfd.ChunkNumber != ngfd.TotalChunks && int64(ngfd.ChunkSize) != size {
+		return "The chunk " + ngfd.Identifier + ":" + ChunkNumberString + " is the wrong size!", http.StatusInternalServerError
+	}
+
+	return "The chunk " + ngfd.Identifier + ":" + ChunkNumberString + " looks great!", http.StatusOK
+}
+
+// ChunksCleanup is used to go through the store and remove any uploads older than timeoutDur, best to set this
+// VERY conservatively.
+func (s *Server) ChunksCleanup(timeoutDur time.Duration) error {
+	uploads, err := s.Store.ListUploads()
+	if err != nil {
+		return err
+	}
+	for _, u := range uploads {
+		s.logf("%s", u.Identifier)
+		s.logf("%s", time.Now().Sub(u.ModTime))
+		if time.Now().Sub(u.ModTime) > timeoutDur {
+			if err = s.Store.DeleteUpload(u.Identifier); err != nil {
+				return err
+			}
+			// u.Identifier can't come back from this; drop whatever we were still tracking
+			// about it (an abandoned upload never reaches the cleanup ChunkUpload itself does)
+			// so none of these keep growing for identifiers that are never going to finish.
+			s.forgetAssembly(u.Identifier)
+			s.chunkDigests.forget(u.Identifier)
+			s.forgetRootsUnder(u.Identifier)
+			s.forgetTusUpload(u.Identifier)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package gongflow
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestChunkUploadConcurrentFinalChunkAssemblesOnce simulates several requests racing to deliver
+// the very last chunk of an otherwise-complete upload (e.g. the client retrying a slow response),
+// which used to be able to race inside Assemble and corrupt or duplicate the final file.  Only
+// one of them should get back the assembled path.
+func TestChunkUploadConcurrentFinalChunkAssemblesOnce(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+
+	ngfd := NgFlowData{
+		ChunkNumber:  2,
+		TotalChunks:  2,
+		ChunkSize:    5,
+		TotalSize:    10,
+		Identifier:   "race-test-upload",
+		Filename:     "race.txt",
+		RelativePath: "race.txt",
+	}
+
+	// The first chunk is already safely uploaded; every goroutine below races to deliver the
+	// second (and last) chunk concurrently.
+	if err := store.WriteChunk(ngfd.Identifier, 1, strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("seeding chunk 1: %v", err)
+	}
+
+	const attempts = 20
+	requests := make([]*http.Request, attempts)
+	for i := range requests {
+		requests[i] = newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 2, 2, 5, 10, []byte("world"))
+	}
+
+	var wg sync.WaitGroup
+	results := make([]string, attempts)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			path, _, err := s.ChunkUpload(ngfd, requests[i])
+			if err != nil {
+				t.Errorf("ChunkUpload attempt %d: %v", i, err)
+				return
+			}
+			results[i] = path
+		}(i)
+	}
+	wg.Wait()
+
+	wantPath := ngfd.Identifier + "/" + ngfd.Filename
+	assembled := 0
+	for i, path := range results {
+		if path == "" {
+			continue
+		}
+		assembled++
+		if path != wantPath {
+			t.Errorf("attempt %d returned unexpected path %q, want %q", i, path, wantPath)
+		}
+	}
+	if assembled != 1 {
+		t.Fatalf("got %d concurrent ChunkUpload calls report the assembled path, want exactly 1", assembled)
+	}
+}
+
+// TestChunkUploadForgetsAssemblyLockOnceDone checks that a completed upload's entry in
+// Server.assembling is dropped instead of being kept around for the life of the Server, which
+// would otherwise leak one *sync.Mutex per distinct identifier ever uploaded.
+func TestChunkUploadForgetsAssemblyLockOnceDone(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+
+	ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 1, TotalSize: 5, Identifier: "forget-test", Filename: "f.txt"}
+	req := newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 1, 1, 5, 5, []byte("hello"))
+	if _, _, err := s.ChunkUpload(ngfd, req); err != nil {
+		t.Fatalf("ChunkUpload: %v", err)
+	}
+
+	s.assembleMu.Lock()
+	_, leaked := s.assembling[ngfd.Identifier]
+	s.assembleMu.Unlock()
+	if leaked {
+		t.Fatalf("assembling still holds an entry for %q after its upload completed", ngfd.Identifier)
+	}
+}
+
+// TestChunksCleanupForgetsTrackedState checks that ChunksCleanup prunes the per-identifier state
+// Server keeps outside the store itself (here the root digest and the assembly lock), not just
+// the chunks in the store -- otherwise those maps grow for the life of the Server
+// regardless of how aggressively uploads are cleaned up.
+func TestChunksCleanupForgetsTrackedState(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	s.HashFactory = sha256.New
+
+	ngfd := NgFlowData{ChunkNumber: 1, TotalChunks: 1, TotalSize: 5, Identifier: "cleanup-test", Filename: "c.txt"}
+	req := newChunkUploadRequest(t, ngfd.Identifier, ngfd.Filename, 1, 1, 5, 5, []byte("hello"))
+	_, root, err := s.ChunkUpload(ngfd, req)
+	if err != nil {
+		t.Fatalf("ChunkUpload: %v", err)
+	}
+
+	if err = s.ChunksCleanup(0); err != nil {
+		t.Fatalf("ChunksCleanup: %v", err)
+	}
+
+	if _, ok := s.Lookup(root); ok {
+		t.Errorf("Lookup(%q) still finds a root digest after ChunksCleanup removed its upload", root)
+	}
+	s.assembleMu.Lock()
+	_, leaked := s.assembling[ngfd.Identifier]
+	s.assembleMu.Unlock()
+	if leaked {
+		t.Errorf("assembling still holds an entry for %q after ChunksCleanup", ngfd.Identifier)
+	}
+}
@@ -0,0 +1,57 @@
+package gongflow
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrIncompleteUpload is returned from Assemble when a store doesn't have exactly the
+// totalChunks contiguous chunks (1..totalChunks) it was asked to combine -- e.g. because a chunk
+// is still missing, or a slot was left holding a partial write from a request that failed before
+// it could be retried into the same chunk number.
+var ErrIncompleteUpload = errors.New("gongflow: upload doesn't have all its chunks")
+
+// contiguousChunks reports whether sortedNumbers is exactly 1..totalChunks, with nothing missing
+// and nothing extra, so an Assemble implementation can refuse to combine a store's chunks if a
+// caller's bookkeeping (and totalChunks) disagrees with what's actually been written.
+func contiguousChunks(sortedNumbers []int, totalChunks int) bool {
+	if len(sortedNumbers) != totalChunks {
+		return false
+	}
+	for i, n := range sortedNumbers {
+		if n != i+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadInfo summarizes the state of a single upload as known by a ChunkStore, so
+// ChunksCleanup doesn't need to know anything about how or where a store actually
+// keeps its chunks.
+type UploadInfo struct {
+	// Identifier is the ng-flow flowIdentifier the upload was started with.
+	Identifier string
+	// ModTime is the last time any chunk belonging to this upload was written.
+	ModTime time.Time
+}
+
+// ChunkStore is the storage backend behind ChunkUpload, ChunkStatus and ChunksCleanup.  It owns
+// everything about where chunks live and how they get assembled into the final file, so gongflow
+// itself doesn't need to know or care whether uploads end up on the local filesystem, in an
+// object store, or nowhere at all (as in tests).
+type ChunkStore interface {
+	// WriteChunk stores chunk n of the upload identified by id, reading exactly size bytes from r.
+	WriteChunk(id string, n int, r io.Reader, size int64) error
+	// ChunkInfo reports the size of chunk n of the upload identified by id.  ok is false if that
+	// chunk hasn't been stored yet.
+	ChunkInfo(id string, n int) (size int64, ok bool, err error)
+	// Assemble combines every chunk stored for id, in chunk-number order, into a single file
+	// named filename and returns where it ended up.
+	Assemble(id, filename string, totalChunks int) (finalPath string, err error)
+	// DeleteUpload removes every chunk (and any assembled file) stored for id.
+	DeleteUpload(id string) error
+	// ListUploads returns every upload currently known to the store.
+	ListUploads() ([]UploadInfo, error)
+}
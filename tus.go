@@ -0,0 +1,274 @@
+package gongflow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// TusVersion is the tus.io resumable upload protocol version gongflow implements.
+const TusVersion = "1.0.0"
+
+// TusExtensions lists the tus.io extensions gongflow supports, advertised via Tus-Extension.
+const TusExtensions = "creation,concatenation"
+
+var (
+	// ErrTusVersionMismatch is returned when a request's Tus-Resumable header isn't TusVersion.
+	ErrTusVersionMismatch = errors.New("gongflow: unsupported Tus-Resumable version")
+	// ErrTusUploadNotFound is returned when a tus request references an identifier gongflow has no record of.
+	ErrTusUploadNotFound = errors.New("gongflow: unknown tus upload")
+	// ErrTusOffsetMismatch is returned when a PATCH's Upload-Offset doesn't match what's actually been stored.
+	ErrTusOffsetMismatch = errors.New("gongflow: tus Upload-Offset doesn't match stored offset")
+)
+
+// chunkReader is an optional capability a ChunkStore can implement to let the tus Concatenation
+// extension read back bytes from chunks it already wrote.  FSStore and MemStore both implement
+// it; stores that can't support it simply can't be used to finalize a concatenated upload.
+type chunkReader interface {
+	ReadChunk(id string, n int) (io.ReadCloser, error)
+}
+
+// tusUpload tracks the bits of a tus upload's state that have nowhere else to live: the total
+// length the client promised up front, how much has arrived so far, how many chunks that's been
+// split across, and whether this is a partial upload destined for the Concatenation extension
+// (which must not be assembled on its own once it reaches its length).
+type tusUpload struct {
+	length   int64
+	offset   int64
+	chunks   int
+	filename string
+	partial  bool
+}
+
+// TusOptions sets the headers tus.io clients expect from an OPTIONS request.
+func TusOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", TusVersion)
+	w.Header().Set("Tus-Version", TusVersion)
+	w.Header().Set("Tus-Extension", TusExtensions)
+}
+
+// TusCreate handles a tus.io creation POST.  It allocates a fresh identifier backed by s.Store
+// and records the Upload-Length and Upload-Metadata the client sent; callers turn the returned
+// identifier into the Location header clients PATCH to.  If Upload-Concat names a "final"
+// upload, the referenced partial uploads are concatenated into the new identifier immediately
+// instead, and the returned identifier is already complete.
+func (s *Server) TusCreate(r *http.Request) (string, error) {
+	if err := checkTusResumable(r); err != nil {
+		return "", err
+	}
+
+	identifier, err := newTusIdentifier()
+	if err != nil {
+		return "", err
+	}
+
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = identifier
+	}
+	if err = validateFilename(filename); err != nil {
+		return "", err
+	}
+
+	if concat := r.Header.Get("Upload-Concat"); strings.HasPrefix(concat, "final;") {
+		partials := strings.Fields(strings.TrimPrefix(concat, "final;"))
+		for i, p := range partials {
+			partials[i] = strings.Trim(p, "/")
+		}
+		if err = s.concatenateTusUploads(identifier, filename, partials); err != nil {
+			return "", err
+		}
+		return identifier, nil
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return "", errors.New("gongflow: bad or missing Upload-Length")
+	}
+
+	s.tusMu.Lock()
+	s.tusUploads[identifier] = &tusUpload{
+		length:   length,
+		filename: filename,
+		partial:  r.Header.Get("Upload-Concat") == "partial",
+	}
+	s.tusMu.Unlock()
+
+	return identifier, nil
+}
+
+// forgetTusUpload drops identifier's entry from tusUploads, if it has one, once
+// ChunksCleanup/DeleteUpload has removed its chunks out from under it -- an upload that's
+// abandoned mid-way never reaches the cleanup TusUpload itself does on completion.
+func (s *Server) forgetTusUpload(identifier string) {
+	s.tusMu.Lock()
+	defer s.tusMu.Unlock()
+	delete(s.tusUploads, identifier)
+}
+
+// TusStatus handles a tus.io HEAD request, reporting the Upload-Offset and Upload-Length to send
+// back for identifier. Like every other tus.io request, r must carry a matching Tus-Resumable
+// header, or ErrTusVersionMismatch is returned instead.
+func (s *Server) TusStatus(r *http.Request, identifier string) (offset int64, length int64, err error) {
+	if err = checkTusResumable(r); err != nil {
+		return 0, 0, err
+	}
+	s.tusMu.Lock()
+	up, ok := s.tusUploads[identifier]
+	s.tusMu.Unlock()
+	if !ok {
+		return 0, 0, ErrTusUploadNotFound
+	}
+	return up.offset, up.length, nil
+}
+
+// TusUpload handles a tus.io PATCH request: it stores body as the next chunk of identifier,
+// rejecting it with ErrTusOffsetMismatch if requestOffset doesn't match what's actually been
+// stored so far.  Once the upload's full length has arrived (and it isn't a partial upload
+// waiting on the Concatenation extension), the chunks are assembled via s.Store and the
+// resulting path is returned alongside the new offset. Like every other tus.io request, r must
+// carry a matching Tus-Resumable header, or ErrTusVersionMismatch is returned instead.
+func (s *Server) TusUpload(r *http.Request, identifier string, requestOffset int64, body io.Reader) (newOffset int64, finalPath string, err error) {
+	if err = checkTusResumable(r); err != nil {
+		return 0, "", err
+	}
+	s.tusMu.Lock()
+	up, ok := s.tusUploads[identifier]
+	s.tusMu.Unlock()
+	if !ok {
+		return 0, "", ErrTusUploadNotFound
+	}
+	if up.offset != requestOffset {
+		return 0, "", ErrTusOffsetMismatch
+	}
+
+	// The whole PATCH body is read up front so WriteChunk is told the size it's actually getting
+	// (tus clients routinely PATCH fewer bytes than the upload has left) rather than the
+	// theoretical remaining total, which a store like S3Store would otherwise pass straight
+	// through as a Content-Length that doesn't match the body.
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	// chunkNum is only committed to up.chunks once WriteChunk actually succeeds, so a client
+	// retrying a PATCH that failed partway through (same Upload-Offset, since it was never
+	// advanced below) overwrites the same chunk slot the failed attempt used instead of being
+	// handed the next one -- which would leave the failed attempt's partial chunk spliced into
+	// the assembled file alongside the retry's.
+	s.tusMu.Lock()
+	chunkNum := up.chunks + 1
+	s.tusMu.Unlock()
+
+	if err = s.Store.WriteChunk(identifier, chunkNum, bytes.NewReader(data), int64(len(data))); err != nil {
+		return 0, "", err
+	}
+
+	s.tusMu.Lock()
+	up.chunks = chunkNum
+	up.offset += int64(len(data))
+	offset := up.offset
+	complete := offset >= up.length && !up.partial
+	s.tusMu.Unlock()
+
+	if !complete {
+		return offset, "", nil
+	}
+
+	finalPath, err = s.Store.Assemble(identifier, up.filename, chunkNum)
+	if err != nil {
+		return offset, "", err
+	}
+	s.tusMu.Lock()
+	delete(s.tusUploads, identifier)
+	s.tusMu.Unlock()
+	return offset, finalPath, nil
+}
+
+// concatenateTusUploads finalizes a tus "final" upload by copying every chunk of every partial
+// upload, in order, into identifier's own chunks, then assembling it under filename.
+func (s *Server) concatenateTusUploads(identifier, filename string, partials []string) error {
+	reader, ok := s.Store.(chunkReader)
+	if !ok {
+		return errors.New("gongflow: store doesn't support reading back chunks, so it can't support tus concatenation")
+	}
+
+	chunkNum := 0
+	for _, partial := range partials {
+		for n := 1; ; n++ {
+			size, ok, err := s.Store.ChunkInfo(partial, n)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			src, err := reader.ReadChunk(partial, n)
+			if err != nil {
+				return err
+			}
+			chunkNum++
+			err = s.Store.WriteChunk(identifier, chunkNum, src, size)
+			src.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := s.Store.Assemble(identifier, filename, chunkNum)
+	return err
+}
+
+// checkTusResumable rejects any request that doesn't advertise the tus.io version we implement.
+func checkTusResumable(r *http.Request) error {
+	if r.Header.Get("Tus-Resumable") != TusVersion {
+		return ErrTusVersionMismatch
+	}
+	return nil
+}
+
+// newTusIdentifier generates a fresh upload identifier that also satisfies validateIdentifier,
+// so tus uploads get the same path-traversal protection as ng-flow ones.
+func newTusIdentifier() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(b)
+	if err := validateIdentifier(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header (a comma-separated list of "key base64value"
+// pairs) into a plain map.
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	if header == "" {
+		return metadata
+	}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(strings.TrimSpace(pair))
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			if decoded, err := base64.StdEncoding.DecodeString(fields[1]); err == nil {
+				value = string(decoded)
+			}
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
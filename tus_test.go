@@ -0,0 +1,225 @@
+package gongflow
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTusRequest(method string, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, "/files", nil)
+	req.Header.Set("Tus-Resumable", TusVersion)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+func TestTusCreateAndUpload(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+
+	req := newTusRequest(http.MethodPost, map[string]string{
+		"Upload-Length":   "11",
+		"Upload-Metadata": "filename aGVsbG8udHh0",
+	})
+	identifier, err := s.TusCreate(req)
+	if err != nil {
+		t.Fatalf("TusCreate: %v", err)
+	}
+
+	offset, length, err := s.TusStatus(req, identifier)
+	if err != nil {
+		t.Fatalf("TusStatus: %v", err)
+	}
+	if offset != 0 || length != 11 {
+		t.Fatalf("TusStatus = (%d, %d), want (0, 11)", offset, length)
+	}
+
+	offset, finalPath, err := s.TusUpload(req, identifier, 0, strings.NewReader("hello "))
+	if err != nil {
+		t.Fatalf("TusUpload (part 1): %v", err)
+	}
+	if offset != 6 || finalPath != "" {
+		t.Fatalf("TusUpload (part 1) = (%d, %q), want (6, \"\")", offset, finalPath)
+	}
+
+	offset, finalPath, err = s.TusUpload(req, identifier, 6, strings.NewReader("world"))
+	if err != nil {
+		t.Fatalf("TusUpload (part 2): %v", err)
+	}
+	if offset != 11 || finalPath == "" {
+		t.Fatalf("TusUpload (part 2) = (%d, %q), want (11, non-empty)", offset, finalPath)
+	}
+
+	data, ok := store.ReadFinal(finalPath)
+	if !ok || string(data) != "hello world" {
+		t.Fatalf("ReadFinal(%q) = (%q, %v), want (\"hello world\", true)", finalPath, data, ok)
+	}
+}
+
+func TestTusUploadRejectsOffsetMismatch(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+	req := newTusRequest(http.MethodPost, map[string]string{"Upload-Length": "5"})
+	identifier, err := s.TusCreate(req)
+	if err != nil {
+		t.Fatalf("TusCreate: %v", err)
+	}
+
+	if _, _, err = s.TusUpload(req, identifier, 3, strings.NewReader("xy")); err != ErrTusOffsetMismatch {
+		t.Fatalf("TusUpload with a stale offset = %v, want ErrTusOffsetMismatch", err)
+	}
+}
+
+// TestTusStatusAndUploadRejectWrongResumableVersion checks that HEAD and PATCH requests are
+// version-checked the same way the creation POST is -- not just on creation.
+func TestTusStatusAndUploadRejectWrongResumableVersion(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+
+	req := newTusRequest(http.MethodPost, map[string]string{"Upload-Length": "5"})
+	identifier, err := s.TusCreate(req)
+	if err != nil {
+		t.Fatalf("TusCreate: %v", err)
+	}
+
+	badReq := newTusRequest(http.MethodHead, nil)
+	badReq.Header.Set("Tus-Resumable", "0.2.2")
+
+	if _, _, err = s.TusStatus(badReq, identifier); err != ErrTusVersionMismatch {
+		t.Fatalf("TusStatus with a bad Tus-Resumable = %v, want ErrTusVersionMismatch", err)
+	}
+	if _, _, err = s.TusUpload(badReq, identifier, 0, strings.NewReader("xy")); err != ErrTusVersionMismatch {
+		t.Fatalf("TusUpload with a bad Tus-Resumable = %v, want ErrTusVersionMismatch", err)
+	}
+}
+
+// flakyChunkStore wraps a ChunkStore and makes the first WriteChunk for a given chunk number fail
+// partway through, simulating a dropped connection mid-PATCH, so tests can exercise a client's
+// retry of the same Upload-Offset.
+type flakyChunkStore struct {
+	ChunkStore
+	failChunk int
+	failed    bool
+}
+
+func (f *flakyChunkStore) WriteChunk(id string, n int, r io.Reader, size int64) error {
+	if n == f.failChunk && !f.failed {
+		f.failed = true
+		return f.ChunkStore.WriteChunk(id, n, &failAfterNBytesReader{r: r, n: 1}, size)
+	}
+	return f.ChunkStore.WriteChunk(id, n, r, size)
+}
+
+// failAfterNBytesReader reads at most n bytes from r before failing, as if the connection carrying
+// them had been dropped mid-request.
+type failAfterNBytesReader struct {
+	r io.Reader
+	n int
+}
+
+func (f *failAfterNBytesReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, errors.New("simulated dropped connection")
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= n
+	if err == nil && f.n <= 0 {
+		err = errors.New("simulated dropped connection")
+	}
+	return n, err
+}
+
+// TestTusUploadRetriesFailedChunkWithoutCorruption reproduces a dropped connection partway through
+// a PATCH: the chunk it was writing is left on disk half-written, but since the client never saw
+// its Upload-Offset advance, it retries the same PATCH. That retry must overwrite the same chunk
+// slot instead of being assigned the next one, or the stale partial bytes end up spliced into the
+// assembled file alongside the successful retry.
+func TestTusUploadRetriesFailedChunkWithoutCorruption(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gongflow-tus-retry")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	store := &flakyChunkStore{ChunkStore: NewFSStore(tempDir), failChunk: 2}
+	s := NewServer(store)
+
+	req := newTusRequest(http.MethodPost, map[string]string{"Upload-Length": "10"})
+	identifier, err := s.TusCreate(req)
+	if err != nil {
+		t.Fatalf("TusCreate: %v", err)
+	}
+
+	offset, _, err := s.TusUpload(req, identifier, 0, strings.NewReader("AAAAA"))
+	if err != nil {
+		t.Fatalf("TusUpload (chunk 1): %v", err)
+	}
+	if offset != 5 {
+		t.Fatalf("TusUpload (chunk 1) offset = %d, want 5", offset)
+	}
+
+	if _, _, err = s.TusUpload(req, identifier, 5, strings.NewReader("BB")); err == nil {
+		t.Fatalf("TusUpload (chunk 2, dropped) succeeded, want the simulated connection drop to fail it")
+	}
+
+	offset, finalPath, err := s.TusUpload(req, identifier, 5, strings.NewReader("BBBBB"))
+	if err != nil {
+		t.Fatalf("TusUpload (chunk 2, retried): %v", err)
+	}
+	if offset != 10 || finalPath == "" {
+		t.Fatalf("TusUpload (chunk 2, retried) = (%d, %q), want (10, non-empty)", offset, finalPath)
+	}
+
+	data, err := ioutil.ReadFile(finalPath)
+	if err != nil {
+		t.Fatalf("ReadFile(%q): %v", finalPath, err)
+	}
+	if string(data) != "AAAAABBBBB" {
+		t.Fatalf("assembled file = %q, want %q", data, "AAAAABBBBB")
+	}
+}
+
+func TestTusConcatenation(t *testing.T) {
+	store := NewMemStore()
+	s := NewServer(store)
+
+	var partialIDs []string
+	for _, content := range []string{"foo", "bar"} {
+		req := newTusRequest(http.MethodPost, map[string]string{
+			"Upload-Length": "3",
+			"Upload-Concat": "partial",
+		})
+		id, err := s.TusCreate(req)
+		if err != nil {
+			t.Fatalf("TusCreate (partial): %v", err)
+		}
+		if _, _, err = s.TusUpload(req, id, 0, strings.NewReader(content)); err != nil {
+			t.Fatalf("TusUpload (partial): %v", err)
+		}
+		partialIDs = append(partialIDs, id)
+	}
+
+	req := newTusRequest(http.MethodPost, map[string]string{
+		"Upload-Concat":   "final;" + strings.Join(partialIDs, " "),
+		"Upload-Metadata": "filename ZmluYWwudHh0",
+	})
+	finalIdentifier, err := s.TusCreate(req)
+	if err != nil {
+		t.Fatalf("TusCreate (final): %v", err)
+	}
+
+	data, ok := store.ReadFinal(finalIdentifier + "/final.txt")
+	if !ok || string(data) != "foobar" {
+		t.Fatalf("ReadFinal after concatenation = (%q, %v), want (\"foobar\", true)", data, ok)
+	}
+}